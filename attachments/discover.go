@@ -0,0 +1,105 @@
+// Package attachments uploads local image/file references found in a
+// markdown document to Confluence as page attachments, so they can be
+// rendered inline instead of as broken links to a path that only exists on
+// the author's machine.
+package attachments
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// schemePattern matches a leading URI scheme, e.g. "https:", "mailto:",
+// "tel:" - anything with one of these isn't a path on disk.
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// LocalImage is a markdown image reference that points at a file on disk
+// rather than a remote URL.
+type LocalImage struct {
+	// Filename is the attachment name it'll be uploaded under, i.e. the base
+	// name of the local path.
+	Filename string
+	// LocalPath is the path to the file on disk, resolved relative to the
+	// directory the markdown file lives in.
+	LocalPath string
+}
+
+// IsLocalReference reports whether destination should be treated as a local
+// file to attach, rather than a link/image left for the default renderer -
+// i.e. it isn't a same-page anchor and doesn't carry a URI scheme (covers
+// absolute URLs like "https://..." as well as non-URL schemes like
+// "mailto:"/"tel:" that also aren't paths on disk).
+func IsLocalReference(destination string) bool {
+	if len(destination) == 0 {
+		return false
+	}
+	if strings.HasPrefix(destination, "#") {
+		return false
+	}
+	return !schemePattern.MatchString(destination)
+}
+
+// isMarkdownPage reports whether destination points at another markdown
+// file - a cross-page link like [other page](./other.md), not a binary to
+// attach. Rewriting these is a separate, not-yet-built page-link feature, so
+// DiscoverLocalImages leaves them alone rather than uploading the raw
+// markdown source as an attachment.
+func isMarkdownPage(destination string) bool {
+	if i := strings.IndexAny(destination, "#?"); i >= 0 {
+		destination = destination[:i]
+	}
+	switch strings.ToLower(filepath.Ext(destination)) {
+	case ".md", ".markdown":
+		return true
+	default:
+		return false
+	}
+}
+
+// DiscoverLocalImages parses content and returns every image or link
+// reference with a local path - e.g. ![diagram](./img/foo.png) or
+// [spec](./spec.pdf) - resolved relative to baseDir (typically the directory
+// the markdown file that contains content lives in).
+func DiscoverLocalImages(content []byte, baseDir string) []LocalImage {
+	doc := parser.NewWithExtensions(parser.CommonExtensions).Parse(content)
+
+	var images []LocalImage
+	seen := make(map[string]bool)
+
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+
+		var destination string
+		switch n := node.(type) {
+		case *ast.Image:
+			destination = string(n.Destination)
+		case *ast.Link:
+			destination = string(n.Destination)
+			if isMarkdownPage(destination) {
+				return ast.GoToNext
+			}
+		default:
+			return ast.GoToNext
+		}
+
+		if !IsLocalReference(destination) || seen[destination] {
+			return ast.GoToNext
+		}
+		seen[destination] = true
+
+		images = append(images, LocalImage{
+			Filename:  filepath.Base(destination),
+			LocalPath: filepath.Join(baseDir, destination),
+		})
+
+		return ast.GoToNext
+	})
+
+	return images
+}
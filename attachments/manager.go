@@ -0,0 +1,116 @@
+package attachments
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/terrycain/markdown2confluence/ratelimit"
+)
+
+// Status describes the outcome of syncing a single attachment.
+type Status int
+
+const (
+	// StatusSkipped means the attachment's tracked hash label already matched, so nothing was uploaded.
+	StatusSkipped Status = iota
+	// StatusUploaded means the attachment was created or updated on the page.
+	StatusUploaded
+)
+
+// Manager uploads local files as Confluence attachments, tracking each one's
+// content hash in a page label so unchanged binaries are skipped on
+// re-upload - the same sha-<hash> labelling scheme the page body uses,
+// extended with an "att-<name>-" prefix to namespace it per attachment.
+// Callers can namespace that further per directory tree via Sync's namespace
+// argument.
+type Manager struct {
+	API ratelimit.API
+}
+
+// NewManager builds a Manager around an already configured Confluence API client.
+func NewManager(api ratelimit.API) *Manager {
+	return &Manager{API: api}
+}
+
+// Sync uploads image.LocalPath as an attachment of pageID named image.Filename,
+// creating it if it doesn't already exist or updating it in place if its
+// content has changed. It's a no-op if the page's tracked hash for this
+// attachment is already current. namespace prefixes the tracked hash label,
+// same as the page's own content-hash label - see
+// FrontMatterDefaults.LabelPrefix - so trees managed independently don't
+// collide on each other's "att-..." labels.
+func (m *Manager) Sync(pageID string, image LocalImage, namespace string) (Status, error) {
+	data, err := ioutil.ReadFile(image.LocalPath)
+	if err != nil {
+		return StatusSkipped, fmt.Errorf("failed to read attachment %s: %w", image.LocalPath, err)
+	}
+
+	labelPrefix := namespace + "att-" + image.Filename + "-"
+	sum := sha256.Sum256(data)
+	wantLabel := labelPrefix + hex.EncodeToString(sum[:])[0:8]
+
+	labels, err := m.API.GetLabels(pageID)
+	if err != nil {
+		return StatusSkipped, fmt.Errorf("failed to get labels for page %s: %w", pageID, err)
+	}
+
+	var haveLabel string
+	for _, label := range labels.Labels {
+		if strings.HasPrefix(label.Name, labelPrefix) {
+			haveLabel = label.Name
+			break
+		}
+	}
+
+	if haveLabel == wantLabel {
+		return StatusSkipped, nil
+	}
+
+	attachmentID, err := m.findAttachmentID(pageID, image.Filename)
+	if err != nil {
+		return StatusSkipped, err
+	}
+
+	if len(attachmentID) == 0 {
+		if _, err := m.API.UploadAttachment(pageID, image.Filename, bytes.NewReader(data)); err != nil {
+			return StatusSkipped, fmt.Errorf("failed to upload attachment %s: %w", image.Filename, err)
+		}
+	} else {
+		if _, err := m.API.UpdateAttachment(pageID, image.Filename, attachmentID, bytes.NewReader(data)); err != nil {
+			return StatusSkipped, fmt.Errorf("failed to update attachment %s: %w", image.Filename, err)
+		}
+	}
+
+	if len(haveLabel) != 0 {
+		if _, err := m.API.DeleteLabel(pageID, haveLabel); err != nil {
+			return StatusSkipped, fmt.Errorf("failed to remove stale attachment label for %s: %w", image.Filename, err)
+		}
+	}
+
+	if _, err := m.API.AddLabels(pageID, &[]goconfluence.Label{{Name: wantLabel}}); err != nil {
+		return StatusSkipped, fmt.Errorf("failed to add attachment label for %s: %w", image.Filename, err)
+	}
+
+	return StatusUploaded, nil
+}
+
+// findAttachmentID returns the ID of pageID's existing attachment named
+// filename, or "" if it doesn't have one yet.
+func (m *Manager) findAttachmentID(pageID, filename string) (string, error) {
+	search, err := m.API.GetAttachments(pageID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list attachments for page %s: %w", pageID, err)
+	}
+
+	for _, result := range search.Results {
+		if result.Title == filename {
+			return result.ID, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,198 @@
+// Package cache maintains a local JSON file recording, per markdown file
+// path, which Confluence page it was last uploaded to and what was uploaded.
+// It exists so that a page rename or move doesn't look like a brand new
+// document: looking the page up by the file's own path survives a title or
+// parent change that would otherwise defeat a Confluence-side title search.
+// It also tracks the content hash of any local assets (e.g. images) a file
+// depends on, so a shared asset changing can be detected even when the
+// referencing file's own content is untouched.
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is everything the cache remembers about one markdown file's last
+// successful upload.
+type Entry struct {
+	PageID         string            `json:"page_id"`
+	Space          string            `json:"space"`
+	LastTitle      string            `json:"last_title"`
+	ContentSHA     string            `json:"content_sha"`
+	AttachmentSHAs map[string]string `json:"attachment_shas"`
+	ParentID       string            `json:"parent_id"`
+	Dependencies   []string          `json:"dependencies"`
+	LastUploadedAt time.Time         `json:"last_uploaded_at"`
+}
+
+// document is the on-disk shape of the cache file.
+type document struct {
+	// Pages is keyed by the markdown file's absolute path.
+	Pages map[string]Entry `json:"pages"`
+	// Assets is keyed by a local asset's absolute path, storing its content
+	// hash as of the last time any file that depends on it was uploaded.
+	Assets map[string]string `json:"assets"`
+}
+
+// Cache is a local record of past uploads, persisted to a JSON file. It's
+// safe for concurrent use.
+type Cache struct {
+	mu   sync.Mutex
+	path string
+	doc  document
+}
+
+// PathForBaseURL returns the cache file path for a given Confluence base URL,
+// namespacing it under the user's cache directory so multiple Confluence
+// instances don't share a cache: ~/.cache/markdown2confluence/<base-url>.db.
+func PathForBaseURL(baseURL string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".cache", "markdown2confluence", sanitizeBaseURL(baseURL)+".db"), nil
+}
+
+func sanitizeBaseURL(baseURL string) string {
+	replacer := strings.NewReplacer("://", "_", "/", "_", ":", "_")
+	return replacer.Replace(baseURL)
+}
+
+// Open loads the cache file at path, if it exists, or returns an empty Cache
+// ready to be populated and saved there.
+func Open(path string) (*Cache, error) {
+	c := &Cache{
+		path: path,
+		doc:  document{Pages: make(map[string]Entry), Assets: make(map[string]string)},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync cache %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &c.doc); err != nil {
+		return nil, fmt.Errorf("failed to parse sync cache %s: %w", path, err)
+	}
+	if c.doc.Pages == nil {
+		c.doc.Pages = make(map[string]Entry)
+	}
+	if c.doc.Assets == nil {
+		c.doc.Assets = make(map[string]string)
+	}
+
+	return c, nil
+}
+
+// Get returns the cached entry for an absolute file path, if one exists.
+// Callers are expected to normalize paths with filepath.Abs before calling
+// Get/Set - findFiles does this for every DiscoveredFile.Path - so the same
+// file is recognised across invocations from different working directories.
+func (c *Cache) Get(path string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.doc.Pages[path]
+	return entry, ok
+}
+
+// Set records or replaces the cached entry for an absolute file path.
+func (c *Cache) Set(path string, entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.doc.Pages[path] = entry
+}
+
+// AssetSHA returns the content hash an asset had as of the last upload that
+// referenced it.
+func (c *Cache) AssetSHA(path string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sha, ok := c.doc.Assets[path]
+	return sha, ok
+}
+
+// SetAssetSHA records an asset's current content hash.
+func (c *Cache) SetAssetSHA(path, sha string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.doc.Assets[path] = sha
+}
+
+// Dependents returns the file paths of every cached page whose Dependencies
+// include assetPath, i.e. every page that needs re-uploading when that
+// shared asset changes. The watch command uses this to map a filesystem
+// event on a non-markdown file back to the markdown files that reference it.
+func (c *Cache) Dependents(assetPath string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var dependents []string
+	for path, entry := range c.doc.Pages {
+		for _, dep := range entry.Dependencies {
+			if dep == assetPath {
+				dependents = append(dependents, path)
+				break
+			}
+		}
+	}
+	return dependents
+}
+
+// Children returns the file paths of every cached page whose ParentID is
+// parentPageID, i.e. every page nested directly under it in the Confluence
+// hierarchy. The uploader passes each of these to Invalidate to drop a page's
+// cached children when its own identity changes out from under them (e.g. it
+// was deleted and recreated with a new page ID upstream), so they're resolved
+// fresh on their next upload rather than silently left pointing at a stale
+// ancestor.
+func (c *Cache) Children(parentPageID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var children []string
+	for path, entry := range c.doc.Pages {
+		if entry.ParentID == parentPageID {
+			children = append(children, path)
+		}
+	}
+	return children
+}
+
+// Invalidate drops the cached entry for an absolute file path, if one
+// exists, so its next upload falls back to a title-based lookup instead of
+// trusting a page identity that's no longer current.
+func (c *Cache) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.doc.Pages, path)
+}
+
+// Save writes the cache to its file, creating its parent directory if needed.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.MarshalIndent(c.doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync cache: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create sync cache directory: %w", err)
+	}
+
+	if err := ioutil.WriteFile(c.path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write sync cache %s: %w", c.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultsFileNames are the per-directory default-frontmatter files findFiles
+// looks for, checked in this order - the first one present in a directory wins.
+var defaultsFileNames = []string{"_defaults.yaml", ".confluence.yaml"}
+
+// FrontMatterDefaults holds directory-level frontmatter defaults loaded from a
+// _defaults.yaml/.confluence.yaml file. findFiles cascades these down the
+// directory tree it walks - a deeper directory's defaults override a
+// shallower one's - and a file's own frontmatter always overrides both.
+type FrontMatterDefaults struct {
+	Space               string `yaml:"space"`
+	ParentID            string `yaml:"parent_id"`
+	ParentTitle         string `yaml:"parent_title"`
+	LabelPrefix         string `yaml:"label_prefix"`
+	ParentTitleFromPath bool   `yaml:"parent_title_from_path"`
+}
+
+// merge layers override on top of d, returning the combined defaults. Only
+// override's non-zero fields take effect, so a directory that doesn't set
+// e.g. "space" inherits whatever its parent resolved to.
+func (d FrontMatterDefaults) merge(override FrontMatterDefaults) FrontMatterDefaults {
+	merged := d
+	if len(override.Space) != 0 {
+		merged.Space = override.Space
+	}
+	if len(override.ParentID) != 0 {
+		merged.ParentID = override.ParentID
+	}
+	if len(override.ParentTitle) != 0 {
+		merged.ParentTitle = override.ParentTitle
+	}
+	if len(override.LabelPrefix) != 0 {
+		merged.LabelPrefix = override.LabelPrefix
+	}
+	if override.ParentTitleFromPath {
+		merged.ParentTitleFromPath = true
+	}
+	return merged
+}
+
+// contentLabelPrefix returns the prefix a page's content-hash label is
+// expected to start with - "sha-", namespaced with LabelPrefix if set.
+func (d FrontMatterDefaults) contentLabelPrefix() string {
+	return d.LabelPrefix + "sha-"
+}
+
+// loadDirDefaults reads dir's defaults file, if it has one, returning a zero
+// value FrontMatterDefaults if neither defaultsFileNames candidate exists.
+func loadDirDefaults(dir string) (FrontMatterDefaults, error) {
+	for _, name := range defaultsFileNames {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return FrontMatterDefaults{}, err
+		}
+
+		var defaults FrontMatterDefaults
+		if err := yaml.Unmarshal(data, &defaults); err != nil {
+			return FrontMatterDefaults{}, fmt.Errorf("failed to parse %s: %w", filepath.Join(dir, name), err)
+		}
+		return defaults, nil
+	}
+	return FrontMatterDefaults{}, nil
+}
+
+// applyDefaults fills in any of f's fields left blank by the file's own
+// frontmatter with defaults cascaded down from its directory tree. ParentID
+// and ParentTitle are only taken from defaults together, so a file's own
+// ParentTitle isn't paired with a directory's unrelated ParentID.
+//
+// f.ContentSHA is namespaced with defaults.LabelPrefix, if set, so trees
+// managed independently (e.g. two markdown2confluence roots writing into the
+// same space) don't collide on each other's "sha-..." labels.
+func (f *FrontMatterStruct) applyDefaults(defaults FrontMatterDefaults) {
+	if len(f.Space) == 0 {
+		f.Space = defaults.Space
+	}
+	if len(f.ParentID) == 0 && len(f.ParentTitle) == 0 {
+		f.ParentID = defaults.ParentID
+		f.ParentTitle = defaults.ParentTitle
+	}
+	if len(defaults.LabelPrefix) != 0 {
+		f.ContentSHA = defaults.LabelPrefix + f.ContentSHA
+	}
+}
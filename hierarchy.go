@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/terrycain/markdown2confluence/ratelimit"
+)
+
+// HierarchyResolver resolves a file's directory path to a chain of Confluence
+// placeholder pages, creating any that don't exist yet. It's shared across a
+// whole run so that concurrent uploads of files under the same or overlapping
+// directories serialize on (and memoize) the segments they have in common,
+// instead of each racing to check-then-create the same placeholder page.
+type HierarchyResolver struct {
+	api ratelimit.API
+
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+// NewHierarchyResolver builds a HierarchyResolver around an already configured
+// Confluence API client.
+func NewHierarchyResolver(api ratelimit.API) *HierarchyResolver {
+	return &HierarchyResolver{
+		api:      api,
+		resolved: make(map[string]string),
+	}
+}
+
+// Ensure resolves relDir (a file's directory relative to its search root,
+// e.g. "guides/setup") to a Confluence page ID, by walking its path segments
+// as nested page titles under rootAncestor. Each segment is looked up by
+// title across the whole space, and an existing page with that title is used
+// wherever it sits; a segment with no page of that title in the space is
+// created as an empty placeholder page under the previous one, so
+// parent_title_from_path works against a directory tree that has no pages in
+// it yet.
+//
+// The whole walk runs under a single mutex and memoizes every prefix it
+// resolves, keyed by space and path-so-far, so two files sharing a directory
+// chain never look up or create the same placeholder page twice.
+func (h *HierarchyResolver) Ensure(space, relDir, rootAncestor string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	parentID := rootAncestor
+
+	if relDir == "." || len(relDir) == 0 {
+		return parentID, nil
+	}
+
+	key := space + "\x00"
+	for _, title := range strings.Split(filepath.ToSlash(relDir), "/") {
+		if len(title) == 0 {
+			continue
+		}
+		key += title + "/"
+
+		if id, ok := h.resolved[key]; ok {
+			parentID = id
+			continue
+		}
+
+		page, found, err := GetPageFromName(h.api, space, title)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up placeholder page %q: %w", title, err)
+		}
+
+		if !found {
+			placeholder := goconfluence.Content{
+				Title:  title,
+				Type:   "page",
+				Space:  goconfluence.Space{Key: space},
+				Status: "current",
+				Ancestors: []goconfluence.Ancestor{
+					{ID: parentID},
+				},
+				Body: goconfluence.Body{
+					Storage: goconfluence.Storage{
+						Value:          "",
+						Representation: "storage",
+					},
+				},
+			}
+
+			newPage, err := h.api.CreateContent(&placeholder)
+			if err != nil {
+				return "", fmt.Errorf("failed to create placeholder page %q: %w", title, err)
+			}
+			page = *newPage
+		}
+
+		parentID = page.ID
+		h.resolved[key] = parentID
+	}
+
+	return parentID, nil
+}
@@ -0,0 +1,136 @@
+package macros
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// admonitionMacros maps a GFM admonition marker, e.g. "[!WARNING]", to the
+// Confluence panel macro that best represents it.
+var admonitionMacros = map[string]string{
+	"NOTE":      "info",
+	"TIP":       "tip",
+	"IMPORTANT": "note",
+	"WARNING":   "warning",
+	"CAUTION":   "warning",
+}
+
+// AdmonitionRenderer turns a GitHub-style admonition blockquote:
+//
+//	> [!NOTE]
+//	> Some text.
+//
+// into the equivalent Confluence panel macro, e.g. <ac:structured-macro
+// ac:name="info">. Blockquotes that don't start with a recognised marker are
+// left for the default renderer to turn into a plain <blockquote>.
+type AdmonitionRenderer struct{}
+
+func (AdmonitionRenderer) Match(node ast.Node) bool {
+	blockQuote, ok := node.(*ast.BlockQuote)
+	if !ok {
+		return false
+	}
+	_, ok = admonitionType(blockQuote)
+	return ok
+}
+
+// admonitionMacroNames remembers the macro name a blockQuote resolved to
+// between its entering and leaving Render calls, keyed by node pointer.
+// stripMarker removes the "[!TYPE]" marker text that admonitionType detects,
+// so without this the leaving call's re-Match would see a blockquote that no
+// longer looks like an admonition and fall through to a plain </blockquote>.
+// Entries are removed as soon as the leaving call reads them, so this never
+// grows beyond the admonition blockquotes currently being rendered.
+var admonitionMacroNames sync.Map
+
+func (AdmonitionRenderer) Render(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	blockQuote := node.(*ast.BlockQuote)
+
+	if entering {
+		macroName, _ := admonitionType(blockQuote)
+		admonitionMacroNames.Store(blockQuote, macroName)
+		stripMarker(blockQuote)
+
+		io.WriteString(w, `<ac:structured-macro ac:name="`+macroName+`"><ac:rich-text-body>`)
+		// Don't render our own body text here - returning GoToNext instead of
+		// SkipChildren lets the blockquote's paragraphs render through the
+		// normal pipeline below, the same as everywhere else in the document,
+		// so inline formatting (links, code spans, bold) and multi-paragraph
+		// bodies come through instead of being flattened to plain text.
+		return ast.GoToNext, true
+	}
+
+	io.WriteString(w, `</ac:rich-text-body></ac:structured-macro>`)
+	admonitionMacroNames.Delete(blockQuote)
+	return ast.GoToNext, true
+}
+
+// admonitionType reports the Confluence macro name for blockQuote's marker,
+// if its text starts with a recognised "[!TYPE]" admonition marker. Once
+// Render has stripped that marker out of the tree, the marker text this
+// would otherwise look for is gone, so it checks admonitionMacroNames for an
+// already-resolved name first.
+func admonitionType(blockQuote *ast.BlockQuote) (string, bool) {
+	if cached, ok := admonitionMacroNames.Load(blockQuote); ok {
+		name := cached.(string)
+		return name, len(name) != 0
+	}
+
+	text := strings.TrimSpace(blockQuoteText(blockQuote))
+	if !strings.HasPrefix(text, "[!") {
+		return "", false
+	}
+
+	end := strings.Index(text, "]")
+	if end < 0 {
+		return "", false
+	}
+
+	marker := strings.ToUpper(strings.TrimSpace(text[2:end]))
+	macroName, ok := admonitionMacros[marker]
+	return macroName, ok
+}
+
+// stripMarker removes the leading "[!TYPE]" admonition marker from
+// blockQuote's first Text leaf, in place, so it doesn't end up in the
+// rendered macro body alongside the rest of the blockquote's content.
+func stripMarker(blockQuote *ast.BlockQuote) {
+	ast.WalkFunc(blockQuote, func(n ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		text, ok := n.(*ast.Text)
+		if !ok {
+			return ast.GoToNext
+		}
+
+		trimmed := strings.TrimLeft(string(text.Literal), " \t\n")
+		end := strings.Index(trimmed, "]")
+		if !strings.HasPrefix(trimmed, "[!") || end < 0 {
+			return ast.Terminate
+		}
+		text.Literal = []byte(strings.TrimLeft(trimmed[end+1:], " \t\n"))
+		return ast.Terminate
+	})
+}
+
+// blockQuoteText concatenates the literal text of every Text leaf under node,
+// joining separate paragraphs with a space. Used only to detect the marker -
+// admonitionType - never to build rendered output, so it doesn't need to
+// preserve inline formatting.
+func blockQuoteText(node ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if text, ok := n.(*ast.Text); ok && entering {
+			if sb.Len() > 0 {
+				sb.WriteString(" ")
+			}
+			sb.Write(text.Literal)
+		}
+		return ast.GoToNext
+	})
+	return sb.String()
+}
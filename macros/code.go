@@ -0,0 +1,56 @@
+package macros
+
+import (
+	"io"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+const codeMacroStart = `<ac:structured-macro ac:name="code">`
+const codeMacroLanguage = `<ac:parameter ac:name="language">LANGUAGE</ac:parameter>`
+const codeMacroBody = `<ac:plain-text-body><![CDATA[BODY]]></ac:plain-text-body>`
+const codeMacroStop = `</ac:structured-macro>`
+
+// diagramMacros maps a fenced code block's info string to the name of the
+// Confluence structured macro that renders it as a diagram, rather than as a
+// plain code listing.
+var diagramMacros = map[string]string{
+	"mermaid":  "mermaid-cloud",
+	"plantuml": "plantuml",
+}
+
+// CodeBlockRenderer renders fenced code blocks as the Confluence "code" macro,
+// same as the original renderHookDropCodeBlock. Mermaid and PlantUML fences
+// are instead rendered as their respective diagramming macros, with the
+// fenced content passed through as the diagram source.
+type CodeBlockRenderer struct{}
+
+func (CodeBlockRenderer) Match(node ast.Node) bool {
+	_, ok := node.(*ast.CodeBlock)
+	return ok
+}
+
+func (CodeBlockRenderer) Render(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	codeBlock := node.(*ast.CodeBlock)
+	info := string(codeBlock.Info)
+
+	if macroName, ok := diagramMacros[info]; ok {
+		io.WriteString(w, `<ac:structured-macro ac:name="`+macroName+`">`)
+		io.WriteString(w, strings.Replace(codeMacroBody, "BODY", string(codeBlock.Literal), 1))
+		io.WriteString(w, codeMacroStop)
+		return ast.GoToNext, true
+	}
+
+	parts := make([]string, 5)
+	parts = append(parts, codeMacroStart)
+	if len(info) > 0 {
+		parts = append(parts, strings.Replace(codeMacroLanguage, "LANGUAGE", info, 1))
+	}
+	parts = append(parts, strings.Replace(codeMacroBody, "BODY", string(codeBlock.Literal), 1))
+	parts = append(parts, codeMacroStop)
+
+	io.WriteString(w, strings.Join(parts, "\n"))
+
+	return ast.GoToNext, true
+}
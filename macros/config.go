@@ -0,0 +1,70 @@
+package macros
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config describes user-registered shortcode renderers loaded from a YAML
+// file, each backed by a Go template that renders the shortcode's macro XML.
+//
+// Example:
+//
+//	shortcodes:
+//	  - name: callout
+//	    template: templates/callout.tmpl
+type Config struct {
+	Shortcodes []TemplateShortcode `yaml:"shortcodes"`
+}
+
+// TemplateShortcode names a shortcode and the template file that renders it.
+// The template is executed with the matched Shortcode as its data, so it can
+// reference {{.Name}}, {{.Args.color}} and {{.Body}}.
+type TemplateShortcode struct {
+	Name         string `yaml:"name"`
+	TemplateFile string `yaml:"template"`
+}
+
+// LoadConfig reads a macro configuration file and parses its templates,
+// returning one ShortcodeRenderer per configured entry.
+func LoadConfig(path string) ([]ShortcodeRenderer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read macro config %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse macro config %s: %w", path, err)
+	}
+
+	renderers := make([]ShortcodeRenderer, 0, len(cfg.Shortcodes))
+	for _, sc := range cfg.Shortcodes {
+		tmpl, err := template.ParseFiles(sc.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s for shortcode %q: %w", sc.TemplateFile, sc.Name, err)
+		}
+		renderers = append(renderers, &templateShortcodeRenderer{name: sc.Name, tmpl: tmpl})
+	}
+	return renderers, nil
+}
+
+// templateShortcodeRenderer renders a Shortcode through a user-supplied Go template.
+type templateShortcodeRenderer struct {
+	name string
+	tmpl *template.Template
+}
+
+func (t *templateShortcodeRenderer) Name() string { return t.name }
+
+func (t *templateShortcodeRenderer) Render(sc Shortcode) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, sc); err != nil {
+		return "", fmt.Errorf("failed to render template for shortcode %q: %w", t.name, err)
+	}
+	return buf.String(), nil
+}
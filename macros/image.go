@@ -0,0 +1,65 @@
+package macros
+
+import (
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// schemePattern matches a leading URI scheme, e.g. "https:", "mailto:",
+// "tel:" - anything with one of these isn't a path on disk.
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// ImageRenderer rewrites markdown images with a local path, e.g.
+// ![diagram](./img/foo.png), to the Confluence <ac:image> macro referencing
+// an uploaded attachment by filename. Images pointing at a remote URL are
+// left for the default renderer to turn into a plain <img>.
+type ImageRenderer struct{}
+
+func (ImageRenderer) Match(node ast.Node) bool {
+	image, ok := node.(*ast.Image)
+	if !ok {
+		return false
+	}
+	return isLocalImage(string(image.Destination))
+}
+
+func (ImageRenderer) Render(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	if !entering {
+		return ast.GoToNext, true
+	}
+
+	image := node.(*ast.Image)
+	filename := filepath.Base(string(image.Destination))
+
+	io.WriteString(w, `<ac:image><ri:attachment ri:filename="`+filename+`"/></ac:image>`)
+
+	// The alt text is rendered as this node's children; we've already
+	// written the full macro, so skip them rather than letting the default
+	// renderer emit them as stray text.
+	return ast.SkipChildren, true
+}
+
+func isLocalImage(destination string) bool {
+	if len(destination) == 0 || strings.HasPrefix(destination, "#") {
+		return false
+	}
+	return !schemePattern.MatchString(destination)
+}
+
+// isMarkdownPage reports whether destination points at another markdown
+// file - a cross-page link, not a binary to attach.
+func isMarkdownPage(destination string) bool {
+	if i := strings.IndexAny(destination, "#?"); i >= 0 {
+		destination = destination[:i]
+	}
+	switch strings.ToLower(filepath.Ext(destination)) {
+	case ".md", ".markdown":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package macros
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// LinkRenderer rewrites markdown links with a local non-markdown path, e.g.
+// [spec](./spec.pdf), to the Confluence <ac:link> macro referencing an
+// uploaded attachment by filename, with the link text carried over as its
+// plain-text body. Links pointing at a remote URL, a same-page anchor, or
+// another markdown file (a cross-page link, not an attachment - that's a
+// separate, not-yet-built page-link feature) are left for the default
+// renderer to turn into a plain <a>.
+type LinkRenderer struct{}
+
+func (LinkRenderer) Match(node ast.Node) bool {
+	link, ok := node.(*ast.Link)
+	if !ok {
+		return false
+	}
+	destination := string(link.Destination)
+	return isLocalImage(destination) && !isMarkdownPage(destination)
+}
+
+func (LinkRenderer) Render(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	if !entering {
+		return ast.GoToNext, true
+	}
+
+	link := node.(*ast.Link)
+	filename := filepath.Base(string(link.Destination))
+
+	io.WriteString(w, `<ac:link><ri:attachment ri:filename="`+filename+`"/><ac:plain-text-link-body><![CDATA[`+linkText(link)+`]]></ac:plain-text-link-body></ac:link>`)
+
+	// The link text is rendered as this node's children; we've already
+	// written it into the macro's link body above, so skip them rather than
+	// letting the default renderer emit them again as stray text.
+	return ast.SkipChildren, true
+}
+
+// linkText returns the concatenated literal text of node's *ast.Text
+// descendants, i.e. the plain-text rendering of a link's visible label.
+func linkText(node ast.Node) string {
+	var text []byte
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if entering {
+			if t, ok := n.(*ast.Text); ok {
+				text = append(text, t.Literal...)
+			}
+		}
+		return ast.GoToNext
+	})
+	return string(text)
+}
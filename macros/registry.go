@@ -0,0 +1,67 @@
+// Package macros renders markdown constructs that have no native HTML
+// equivalent into Confluence storage-format macro XML: fenced code blocks,
+// GFM-style admonitions, and Hugo-style shortcodes such as {{< toc >}}.
+package macros
+
+import (
+	"io"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// NodeRenderer renders a single kind of AST node to Confluence storage-format
+// XML. It plugs into a Registry, which composes many of these into a single
+// html.RendererOptions.RenderNodeHook.
+type NodeRenderer interface {
+	// Match reports whether this renderer knows how to handle node.
+	Match(node ast.Node) bool
+	// Render writes node's storage-format XML to w. It has the same signature
+	// and semantics as html.RenderNodeFunc: the returned bool reports whether
+	// the node was fully handled, in which case the default renderer is skipped.
+	Render(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool)
+}
+
+// Registry composes a set of NodeRenderers into a single RenderNodeHook,
+// trying each in turn and falling back to the default HTML renderer if none
+// match.
+type Registry struct {
+	renderers []NodeRenderer
+}
+
+// NewRegistry builds a Registry from an initial set of renderers. Callers can
+// add more via Register, including their own NodeRenderer implementations.
+func NewRegistry(renderers ...NodeRenderer) *Registry {
+	return &Registry{renderers: renderers}
+}
+
+// Register adds a NodeRenderer to the registry. Renderers are tried in the
+// order they were registered, so a custom renderer registered after the
+// defaults can't override them for the same node type - register it first if
+// that's needed.
+func (r *Registry) Register(renderer NodeRenderer) {
+	r.renderers = append(r.renderers, renderer)
+}
+
+// RenderHook is an html.RenderNodeFunc that dispatches to the first matching
+// NodeRenderer in the registry.
+func (r *Registry) RenderHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	for _, renderer := range r.renderers {
+		if renderer.Match(node) {
+			return renderer.Render(w, node, entering)
+		}
+	}
+	return ast.GoToNext, false
+}
+
+// DefaultRenderers returns the renderers markdown2confluence ships out of the
+// box: fenced code blocks (including mermaid/plantuml diagrams), GFM-style
+// admonition blockquotes, and local images/links rewritten to reference
+// uploaded attachments.
+func DefaultRenderers() []NodeRenderer {
+	return []NodeRenderer{
+		&CodeBlockRenderer{},
+		&AdmonitionRenderer{},
+		&ImageRenderer{},
+		&LinkRenderer{},
+	}
+}
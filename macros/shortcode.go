@@ -0,0 +1,138 @@
+package macros
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Shortcode is a parsed Hugo-style shortcode: {{< name arg="value" >}}body{{< /name >}}
+// or the self-closing {{< name arg="value" >}}.
+type Shortcode struct {
+	Name string
+	Args map[string]string
+	Body string
+}
+
+// ShortcodeRenderer renders one named shortcode to its Confluence storage-format
+// XML, e.g. "toc" -> <ac:structured-macro ac:name="toc">.
+type ShortcodeRenderer interface {
+	Name() string
+	Render(sc Shortcode) (string, error)
+}
+
+// ShortcodeRegistry resolves shortcode placeholders left by ExtractShortcodes
+// back into their rendered macro XML.
+type ShortcodeRegistry struct {
+	renderers map[string]ShortcodeRenderer
+}
+
+// NewShortcodeRegistry builds a ShortcodeRegistry from an initial set of renderers.
+func NewShortcodeRegistry(renderers ...ShortcodeRenderer) *ShortcodeRegistry {
+	registry := &ShortcodeRegistry{renderers: make(map[string]ShortcodeRenderer)}
+	for _, r := range renderers {
+		registry.Register(r)
+	}
+	return registry
+}
+
+// Register adds or replaces the renderer for a shortcode name.
+func (s *ShortcodeRegistry) Register(renderer ShortcodeRenderer) {
+	s.renderers[renderer.Name()] = renderer
+}
+
+// Resolve replaces every placeholder comment in rendered HTML with the macro
+// XML produced by rendering its corresponding shortcode.
+func (s *ShortcodeRegistry) Resolve(renderedHTML string, placeholders map[string]Shortcode) (string, error) {
+	for id, sc := range placeholders {
+		renderer, ok := s.renderers[sc.Name]
+		if !ok {
+			return "", fmt.Errorf("no shortcode renderer registered for %q", sc.Name)
+		}
+
+		macroXML, err := renderer.Render(sc)
+		if err != nil {
+			return "", fmt.Errorf("failed to render shortcode %q: %w", sc.Name, err)
+		}
+
+		renderedHTML = strings.ReplaceAll(renderedHTML, placeholderComment(id), macroXML)
+	}
+	return renderedHTML, nil
+}
+
+// DefaultShortcodeRenderers returns the shortcodes markdown2confluence ships
+// out of the box: {{< toc >}} and {{< status >}}.
+func DefaultShortcodeRenderers() []ShortcodeRenderer {
+	return []ShortcodeRenderer{
+		&TOCRenderer{},
+		&StatusRenderer{},
+	}
+}
+
+// openShortcodeRe matches a shortcode's opening (or self-closing) tag:
+// {{< name arg="value" >}}. A closing tag, {{< /name >}}, never matches here
+// since the mandatory \w+ can't follow the "/".
+var openShortcodeRe = regexp.MustCompile(`\{\{<\s*(\w+)([^>]*?)\s*/?\s*>\}\}`)
+
+var shortcodeArgsRe = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)"`)
+
+// ExtractShortcodes replaces every {{< name arg="value" >}}...{{< /name >}}
+// (or self-closing {{< name arg="value" >}}) shortcode in content with a
+// unique placeholder HTML comment, returning the rewritten content and a map
+// from placeholder ID to the parsed shortcode.
+//
+// This runs before the content is handed to markdown.ToHTML, and the
+// placeholders are resolved back to macro XML after rendering, mirroring how
+// Hugo shortcodes survive Blackfriday rendering untouched by the markdown
+// parser.
+func ExtractShortcodes(content string) (string, map[string]Shortcode) {
+	placeholders := make(map[string]Shortcode)
+	counter := 0
+	var out strings.Builder
+
+	for {
+		loc := openShortcodeRe.FindStringSubmatchIndex(content)
+		if loc == nil {
+			out.WriteString(content)
+			break
+		}
+
+		out.WriteString(content[:loc[0]])
+		name := content[loc[2]:loc[3]]
+		args := parseShortcodeArgs(content[loc[4]:loc[5]])
+		rest := content[loc[1]:]
+
+		sc := Shortcode{Name: name, Args: args}
+		if closeLoc := closingShortcodeTag(name).FindStringIndex(rest); closeLoc != nil {
+			sc.Body = strings.TrimSpace(rest[:closeLoc[0]])
+			rest = rest[closeLoc[1]:]
+		}
+
+		id := fmt.Sprintf("%d", counter)
+		counter++
+		placeholders[id] = sc
+		out.WriteString(placeholderComment(id))
+
+		content = rest
+	}
+
+	return out.String(), placeholders
+}
+
+// closingShortcodeTag builds the regexp matching a shortcode's closing tag,
+// e.g. {{< /status >}} for name "status".
+func closingShortcodeTag(name string) *regexp.Regexp {
+	return regexp.MustCompile(`\{\{<\s*/\s*` + regexp.QuoteMeta(name) + `\s*>\}\}`)
+}
+
+func parseShortcodeArgs(raw string) map[string]string {
+	args := make(map[string]string)
+	for _, m := range shortcodeArgsRe.FindAllStringSubmatch(raw, -1) {
+		args[m[1]] = m[2]
+	}
+	return args
+}
+
+func placeholderComment(id string) string {
+	return "<!--m2c:" + id + "-->"
+}
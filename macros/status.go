@@ -0,0 +1,34 @@
+package macros
+
+import (
+	"fmt"
+	"html"
+)
+
+// statusColours are the colours Confluence's status macro accepts.
+var statusColours = map[string]bool{
+	"grey": true, "red": true, "yellow": true, "green": true, "blue": true,
+}
+
+// StatusRenderer renders the {{< status color="green" >}}Done{{< /status >}}
+// shortcode as the Confluence status lozenge macro.
+type StatusRenderer struct{}
+
+func (StatusRenderer) Name() string { return "status" }
+
+func (StatusRenderer) Render(sc Shortcode) (string, error) {
+	colour := sc.Args["color"]
+	if !statusColours[colour] {
+		colour = "grey"
+	}
+
+	title := sc.Body
+	if len(title) == 0 {
+		title = sc.Args["title"]
+	}
+
+	return fmt.Sprintf(
+		`<ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">%s</ac:parameter><ac:parameter ac:name="title">%s</ac:parameter></ac:structured-macro>`,
+		colour, html.EscapeString(title),
+	), nil
+}
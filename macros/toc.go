@@ -0,0 +1,11 @@
+package macros
+
+// TOCRenderer renders the {{< toc >}} shortcode as the Confluence table of
+// contents macro.
+type TOCRenderer struct{}
+
+func (TOCRenderer) Name() string { return "toc" }
+
+func (TOCRenderer) Render(sc Shortcode) (string, error) {
+	return `<ac:structured-macro ac:name="toc" />`, nil
+}
@@ -1,23 +1,20 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
-	"github.com/alecthomas/kong"
-	"github.com/cseeger-epages/confluence-go-api"
-	"github.com/ericaro/frontmatter"
-	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/ast"
-	"github.com/gomarkdown/markdown/html"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/markdown2confluence/cache"
+	"github.com/terrycain/markdown2confluence/macros"
+	"github.com/terrycain/markdown2confluence/ratelimit"
 )
 
 type FrontMatterStruct struct {
@@ -29,243 +26,93 @@ type FrontMatterStruct struct {
 	ContentSHA  string
 }
 
-var CLI struct {
-	LogLevel string `env:"LOG_LEVEL" enum:"DEBUG,INFO,WARNING,ERROR" default:"INFO" help:"Logger level"`
-	BaseURL         string   `required:"" env:"CONFLUENCE_BASE_URL" help:"Confluence base URL"`
-	User            string   `required:"" env:"CONFLUENCE_USER" help:"Confluence username"`
-	Password        string   `required:"" env:"CONFLUENCE_PASSWORD" help:"Confluence password or API token"`
-	DefaultSpace    string   `env:"CONFLUENCE_DEFAULT_SPACE" help:"Default space to use when uploading markdown documents"`
-	DefaultAncestor string   `env:"CONFLUENCE_DEFAULT_ANCESTOR" help:"Default ancestor to upload documents under, is expected to be a page ID"`
-	Recursive       bool     `env:"CONFLUENCE_RECURSIVE" type:"bool" help:""`
-	Paths           []string `arg:"" name:"path" env:"CONFLUENCE_FILEPATH" default:"." type:"path" help:"Paths to upload to confluence"`
-}
+// ConnectionFlags holds the Confluence connection details shared by every subcommand.
+type ConnectionFlags struct {
+	BaseURL  string `required:"" env:"CONFLUENCE_BASE_URL" help:"Confluence base URL"`
+	User     string `required:"" env:"CONFLUENCE_USER" help:"Confluence username"`
+	Password string `required:"" env:"CONFLUENCE_PASSWORD" help:"Confluence password or API token"`
 
-var LogLevelMap = map[string]zerolog.Level{
-	"DEBUG": zerolog.DebugLevel,
-	"INFO": zerolog.InfoLevel,
-	"WARNING": zerolog.WarnLevel,
-	"ERROR": zerolog.ErrorLevel,
-}
-
-const MACRO_XML_START = `<ac:structured-macro ac:name="code">`
-const MACRO_XML_LANGUAGE = `<ac:parameter ac:name="language">LANGUAGE</ac:parameter>`
-const MACRO_XML_BODY = `<ac:plain-text-body><![CDATA[BODY]]></ac:plain-text-body>`
-const MACRO_XML_STOP = `</ac:structured-macro>`
+	DefaultSpace    string `env:"CONFLUENCE_DEFAULT_SPACE" help:"Default space to use when uploading markdown documents"`
+	DefaultAncestor string `env:"CONFLUENCE_DEFAULT_ANCESTOR" help:"Default ancestor to upload documents under, is expected to be a page ID"`
 
+	RateLimit  float64 `env:"CONFLUENCE_RATE_LIMIT" default:"10" help:"Maximum Confluence API requests per second"`
+	MaxRetries int     `env:"CONFLUENCE_MAX_RETRIES" default:"3" help:"Retries for rate-limited/server-error API calls, with exponential backoff"`
+}
 
-func main() {
-	kong.Parse(&CLI)
-	logLevel, _ := LogLevelMap[CLI.LogLevel]
-	zerolog.SetGlobalLevel(logLevel)
+// PathFlags holds the markdown file discovery flags shared by every subcommand.
+type PathFlags struct {
+	Recursive bool     `env:"CONFLUENCE_RECURSIVE" type:"bool" help:""`
+	Paths     []string `arg:"" name:"path" env:"CONFLUENCE_FILEPATH" default:"." type:"path" help:"Paths to upload to confluence"`
+}
 
-	log.Info().Msg("Starting markdown2confluence")
+// MacroFlags holds the flags for customising macro rendering, shared by every subcommand.
+type MacroFlags struct {
+	MacroConfig string `env:"CONFLUENCE_MACRO_CONFIG" help:"Path to a YAML file registering custom shortcode macros backed by Go templates"`
+}
 
-	files := make([]string, 0)
+// newRenderer builds the markdown renderer and shortcode registry shared by
+// every subcommand, wiring in any custom macros from MacroConfig.
+func newRenderer(macroFlags MacroFlags) (*html.Renderer, *macros.ShortcodeRegistry, error) {
+	nodeRegistry := macros.NewRegistry(macros.DefaultRenderers()...)
+	shortcodeRegistry := macros.NewShortcodeRegistry(macros.DefaultShortcodeRenderers()...)
 
-	for _, item := range CLI.Paths {
-		newFiles, err := findFiles(item, CLI.Recursive)
+	if len(macroFlags.MacroConfig) != 0 {
+		customShortcodes, err := macros.LoadConfig(macroFlags.MacroConfig)
 		if err != nil {
-			fmt.Printf("Got err: %s", err.Error())
-			os.Exit(1)
+			return nil, nil, err
+		}
+		for _, renderer := range customShortcodes {
+			shortcodeRegistry.Register(renderer)
 		}
-		files = append(files, newFiles...)
 	}
 
-	api, err := goconfluence.NewAPI(CLI.BaseURL+"/wiki/rest/api", CLI.User, CLI.Password)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create API client")
-	}
+	renderer := html.NewRenderer(html.RendererOptions{
+		Flags:          html.CommonFlags,
+		RenderNodeHook: nodeRegistry.RenderHook,
+	})
 
-	success := true
+	return renderer, shortcodeRegistry, nil
+}
 
-	// Set up markdown renderer for later use
-	opts := html.RendererOptions{
-		Flags: html.CommonFlags,
-		RenderNodeHook: renderHookDropCodeBlock,
+// openSyncCache opens the local sync cache for a given Confluence base URL,
+// shared by every subcommand so repeated runs recognise pages they've
+// already uploaded, even across a rename.
+func openSyncCache(baseURL string) (*cache.Cache, error) {
+	path, err := cache.PathForBaseURL(baseURL)
+	if err != nil {
+		return nil, err
 	}
-	renderer := html.NewRenderer(opts)
-
-	// Start uploading files
-	for _, file := range files {
-		log.Debug().Msgf("Processing %s", file)
-
-		data, err := ioutil.ReadFile(file)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to read contents of %s, skipping", file)
-			success = false
-			continue
-		}
-
-		// Parse the frontmatter
-		frontmatterPass := FrontMatterStruct{}
-		err = frontmatter.Unmarshal(data, &frontmatterPass)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to process the frontmatter of %s, skipping", file)
-			success = false
-			continue
-		}
-		h := sha256.New()
-		_, err = h.Write([]byte(frontmatterPass.Content))
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to hash the contents of %s, skipping", file)
-			success = false
-			continue
-		}
-		frontmatterPass.ContentSHA = "sha-" + hex.EncodeToString(h.Sum(nil))[0:8]
-
-		// Merge in defaults if we need them
-		if len(frontmatterPass.Space) == 0 {
-			if len(CLI.DefaultSpace) == 0 {
-				log.Error().Msgf("Missing space or default space for file %s", file)
-				success = false
-				continue
-			} else {
-				frontmatterPass.Space = CLI.DefaultSpace
-			}
-		}
-
-		if len(frontmatterPass.ParentID) == 0 {
-			if len(frontmatterPass.ParentTitle) != 0 {
-				// Get page id of parent if title is provided
-				page, _, err := GetPageFromName(api, frontmatterPass.Space, frontmatterPass.ParentTitle)
-				if err != nil {
-					log.Error().Err(err).Msgf("Got error looking up page id for file %s", file)
-					success = false
-					continue
-				}
-				frontmatterPass.ParentID = page.ID
-
-			} else if len(CLI.DefaultAncestor) == 0 {
-				log.Error().Msgf("Missing parent id/title or default ancestor for file %s", file)
-				success = false
-				continue
-			} else {
-				frontmatterPass.ParentID = CLI.DefaultAncestor
-			}
-		}
-
-		if len(frontmatterPass.PageTitle) == 0 {
-			log.Error().Msgf("Frontmatter missing page title for file %s", file)
-			success = false
-			continue
-		}
-
-		// Check if the page exists
-		page, found, err := GetPageFromName(api, frontmatterPass.Space, frontmatterPass.PageTitle)
-
-		// TODO customise html
-		htmlData := markdown.ToHTML([]byte(frontmatterPass.Content), nil, renderer)
-
-		if found && err == nil {
-			// get page version
-			version, err := GetPageVersion(api, page.ID)
-			if err != nil {
-				fmt.Printf("Got error getting page hash: %s\n", err.Error())
-				success = false
-				continue
-			}
-
-			// update page
-			pageHashLabel, err := GetHashFromLabels(api, page.ID)
-			if err != nil {
-				log.Error().Err(err).Msgf("Got error looking up page labels for file %s", file)
-				success = false
-				continue
-			}
-
-			if pageHashLabel.Name == frontmatterPass.ContentSHA {
-				log.Info().Msgf("No update needed for %s", file)
-				continue
-			}
-
-			// Have update, so need to remove label, update, add new label
-			if len(pageHashLabel.Name) != 0 {
-				if _, err := api.DeleteLabel(page.ID, pageHashLabel.Name); err != nil {
-					log.Error().Err(err).Msgf("Got error removing page label for file %s", file)
-					success = false
-					continue
-				}
-			}
-
-			pageContent := goconfluence.Content{
-				ID:    page.ID,
-				Title: frontmatterPass.PageTitle,
-				Version: goconfluence.Version{
-					Number: version + 1,
-				},
-				Type:   "page",
-				Space:  goconfluence.Space{Key: frontmatterPass.Space},
-				Status: "current",
-				Ancestors: []goconfluence.Ancestor{
-					{ID: frontmatterPass.ParentID},
-				},
-				Body: goconfluence.Body{
-					Storage: goconfluence.Storage{
-						Value:          string(htmlData),
-						Representation: "storage",
-					},
-				},
-			}
+	return cache.Open(path)
+}
 
-			if _, err := api.UpdateContent(&pageContent); err != nil {
-				log.Error().Err(err).Msgf("Failed to update page content for file %s", file)
-				success = false
-				continue
-			}
-			log.Info().Msgf("Updated page successfully for %s", file)
+var CLI struct {
+	LogLevel string `env:"LOG_LEVEL" enum:"DEBUG,INFO,WARNING,ERROR" default:"INFO" help:"Logger level"`
 
-			labels := []goconfluence.Label{
-				{Name: frontmatterPass.ContentSHA},
-			}
-			if _, err := api.AddLabels(page.ID, &labels); err != nil {
-				log.Error().Err(err).Msgf("Failed to update page labels for file %s", file)
-				success = false
-				continue
-			}
+	Upload UploadCmd `cmd:"" default:"1" help:"Render markdown files and upload them to Confluence"`
+	Watch  WatchCmd  `cmd:"" help:"Watch paths for changes, serving previews and re-uploading on change"`
+}
 
-		} else {
-			// Create page
-			pageContent := goconfluence.Content{
-				Title:  frontmatterPass.PageTitle,
-				Type:   "page",
-				Space:  goconfluence.Space{Key: frontmatterPass.Space},
-				Status: "current",
-				Ancestors: []goconfluence.Ancestor{
-					{ID: frontmatterPass.ParentID},
-				},
-				Body: goconfluence.Body{
-					Storage: goconfluence.Storage{
-						Value:          string(htmlData),
-						Representation: "storage",
-					},
-				},
-			}
+var LogLevelMap = map[string]zerolog.Level{
+	"DEBUG":   zerolog.DebugLevel,
+	"INFO":    zerolog.InfoLevel,
+	"WARNING": zerolog.WarnLevel,
+	"ERROR":   zerolog.ErrorLevel,
+}
 
-			newPage, err := api.CreateContent(&pageContent)
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to create page for file %s", file)
-				success = false
-				continue
-			}
-			log.Info().Msgf("Created page successfully for %s", file)
+func main() {
+	ctx := kong.Parse(&CLI)
+	logLevel := LogLevelMap[CLI.LogLevel]
+	zerolog.SetGlobalLevel(logLevel)
 
-			labels := []goconfluence.Label{
-				{Name: frontmatterPass.ContentSHA},
-			}
-			if _, err := api.AddLabels(newPage.ID, &labels); err != nil {
-				log.Error().Err(err).Msgf("Failed to update page labels for file %s", file)
-				success = false
-				continue
-			}
-		}
-	}
+	log.Info().Msg("Starting markdown2confluence")
 
-	if !success {
+	if err := ctx.Run(); err != nil {
+		log.Error().Err(err).Msg("Run failed")
 		os.Exit(1)
 	}
 }
 
-func GetPageFromName(api *goconfluence.API, space, pageName string) (goconfluence.Content, bool, error) {
+func GetPageFromName(api ratelimit.API, space, pageName string) (goconfluence.Content, bool, error) {
 	contentSearch, err := api.GetContent(goconfluence.ContentQuery{Title: pageName, SpaceKey: space})
 	if err != nil {
 		return goconfluence.Content{}, false, err
@@ -278,7 +125,7 @@ func GetPageFromName(api *goconfluence.API, space, pageName string) (goconfluenc
 	return contentSearch.Results[0], true, nil
 }
 
-func GetPageVersion(api *goconfluence.API, pageId string) (int, error) {
+func GetPageVersion(api ratelimit.API, pageId string) (int, error) {
 	content, err := api.GetContentByID(pageId, goconfluence.ContentQuery{})
 	if err != nil {
 		return 0, err
@@ -287,81 +134,113 @@ func GetPageVersion(api *goconfluence.API, pageId string) (int, error) {
 	return content.Version.Number, err
 }
 
-func GetHashFromLabels(api *goconfluence.API, pageID string) (goconfluence.Label, error) {
+// GetHashFromLabels returns pageID's content-hash label, i.e. the one
+// starting with prefix (ordinarily "sha-", or a directory's LabelPrefix
+// followed by "sha-" if it's set), or a zero Label if it doesn't have one yet.
+func GetHashFromLabels(api ratelimit.API, pageID, prefix string) (goconfluence.Label, error) {
 	labels, err := api.GetLabels(pageID)
 	if err != nil {
 		return goconfluence.Label{}, err
 	}
 	for _, label := range labels.Labels {
-		if strings.HasPrefix(label.Name, "sha-") {
+		if strings.HasPrefix(label.Name, prefix) {
 			return label, nil
 		}
 	}
 	return goconfluence.Label{}, nil
 }
 
-func findFiles(searchpath string, recursive bool) ([]string, error) {
+// DiscoveredFile is a markdown file found by findFiles, carrying the
+// directory-level frontmatter defaults cascaded down to it from any
+// _defaults.yaml/.confluence.yaml files between the search root and its
+// directory.
+type DiscoveredFile struct {
+	Path string
+	// RelDir is the file's directory relative to the search root it was
+	// discovered under ("." if it's directly inside it), used to derive a
+	// Confluence parent hierarchy when ParentTitleFromPath is set.
+	RelDir   string
+	Defaults FrontMatterDefaults
+}
+
+func findFiles(searchpath string, recursive bool) ([]DiscoveredFile, error) {
+	// Resolve to an absolute path up front so every DiscoveredFile.Path - and
+	// anything keyed by it, e.g. the sync cache - stays stable across
+	// invocations from different working directories, instead of silently
+	// treating "./doc.md" and "/home/user/doc.md" as two different files.
+	searchpath, err := filepath.Abs(searchpath)
+	if err != nil {
+		return nil, err
+	}
+
 	fi, err := os.Stat(searchpath)
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
 
-	result := make([]string, 0)
+	result := make([]DiscoveredFile, 0)
 
 	switch mode := fi.Mode(); {
 	case mode.IsDir():
+		rootDefaults, err := loadDirDefaults(searchpath)
+		if err != nil {
+			return nil, err
+		}
+
 		if recursive {
+			dirDefaults := map[string]FrontMatterDefaults{searchpath: rootDefaults}
 
 			err = filepath.Walk(searchpath, func(walkedpath string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
 				}
-				if !info.IsDir() && strings.HasSuffix(strings.ToLower(info.Name()), ".md") {
-					result = append(result, walkedpath)
+
+				if info.IsDir() {
+					if walkedpath == searchpath {
+						return nil
+					}
+					ownDefaults, err := loadDirDefaults(walkedpath)
+					if err != nil {
+						return err
+					}
+					dirDefaults[walkedpath] = dirDefaults[filepath.Dir(walkedpath)].merge(ownDefaults)
+					return nil
+				}
+
+				if strings.HasSuffix(strings.ToLower(info.Name()), ".md") {
+					dir := filepath.Dir(walkedpath)
+					relDir, err := filepath.Rel(searchpath, dir)
+					if err != nil {
+						return err
+					}
+					result = append(result, DiscoveredFile{Path: walkedpath, RelDir: relDir, Defaults: dirDefaults[dir]})
 				}
 				return nil
 			})
 			if err != nil {
-				return []string{}, err
+				return nil, err
 			}
 
 		} else {
 			files, err := ioutil.ReadDir(searchpath)
 			if err != nil {
-				return []string{}, err
+				return nil, err
 			}
 
 			for _, f := range files {
 				if !f.IsDir() && strings.HasSuffix(strings.ToLower(f.Name()), ".md") {
-					result = append(result, path.Join(searchpath, f.Name()))
+					result = append(result, DiscoveredFile{Path: path.Join(searchpath, f.Name()), RelDir: ".", Defaults: rootDefaults})
 				}
 			}
 		}
 
 	case mode.IsRegular():
-		result = append(result, searchpath)
-	}
-
-	return result, nil
-}
-
-
-func renderHookDropCodeBlock(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
-	if _, ok := node.(*ast.CodeBlock); ok {
-		codeBlock := node.(*ast.CodeBlock)
-		parts := make([]string, 5)
-		parts = append(parts, MACRO_XML_START)
-
-		if len(codeBlock.Info) > 0 {
-			parts = append(parts, strings.Replace(MACRO_XML_LANGUAGE, "LANGUAGE", string(codeBlock.Info), 1))
+		defaults, err := loadDirDefaults(filepath.Dir(searchpath))
+		if err != nil {
+			return nil, err
 		}
-		parts = append(parts, strings.Replace(MACRO_XML_BODY, "BODY", string(codeBlock.Literal), 1))
-		parts = append(parts, MACRO_XML_STOP)
-
-		_, _ = io.WriteString(w, strings.Join(parts, "\n"))
-
-		return ast.GoToNext, true
+		result = append(result, DiscoveredFile{Path: searchpath, RelDir: ".", Defaults: defaults})
 	}
 
-	return ast.GoToNext, false
+	return result, nil
 }
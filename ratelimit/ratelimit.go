@@ -0,0 +1,186 @@
+// Package ratelimit wraps the goconfluence API client with a shared
+// token-bucket rate limit and retry-with-backoff on throttling/server
+// errors, since Atlassian Cloud aggressively rate-limits and intermittently
+// 5xxs under load - which concurrent uploads make far more likely to hit.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"golang.org/x/time/rate"
+)
+
+// API is the subset of goconfluence.API's methods markdown2confluence uses.
+// Both *goconfluence.API and *Limited satisfy it, so the upload pipeline can
+// run against either without caring which.
+type API interface {
+	GetContent(query goconfluence.ContentQuery) (*goconfluence.ContentSearch, error)
+	GetContentByID(id string, query goconfluence.ContentQuery) (*goconfluence.Content, error)
+	CreateContent(c *goconfluence.Content) (*goconfluence.Content, error)
+	UpdateContent(c *goconfluence.Content) (*goconfluence.Content, error)
+	GetLabels(id string) (*goconfluence.Labels, error)
+	AddLabels(id string, labels *[]goconfluence.Label) (*goconfluence.Labels, error)
+	DeleteLabel(id string, name string) (*goconfluence.Labels, error)
+	GetAttachments(id string) (*goconfluence.Search, error)
+	UploadAttachment(id, attachmentName string, attachment io.Reader) (*goconfluence.Search, error)
+	UpdateAttachment(id, attachmentName, attachmentID string, attachment io.Reader) (*goconfluence.Search, error)
+}
+
+// Limited wraps a *goconfluence.API, rate limiting and retrying every call
+// made through it. It's safe for concurrent use.
+type Limited struct {
+	api        *goconfluence.API
+	limiter    *rate.Limiter
+	maxRetries int
+}
+
+// New wraps api, allowing up to ratePerSecond requests/second (with a burst
+// of the same size), retrying a retryable failure up to maxRetries times
+// with exponential backoff.
+func New(api *goconfluence.API, ratePerSecond float64, maxRetries int) *Limited {
+	burst := int(ratePerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limited{
+		api:        api,
+		limiter:    rate.NewLimiter(rate.Limit(ratePerSecond), burst),
+		maxRetries: maxRetries,
+	}
+}
+
+func (l *Limited) GetContent(query goconfluence.ContentQuery) (*goconfluence.ContentSearch, error) {
+	var result *goconfluence.ContentSearch
+	err := l.call(func() (err error) {
+		result, err = l.api.GetContent(query)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) GetContentByID(id string, query goconfluence.ContentQuery) (*goconfluence.Content, error) {
+	var result *goconfluence.Content
+	err := l.call(func() (err error) {
+		result, err = l.api.GetContentByID(id, query)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) CreateContent(c *goconfluence.Content) (*goconfluence.Content, error) {
+	var result *goconfluence.Content
+	err := l.call(func() (err error) {
+		result, err = l.api.CreateContent(c)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) UpdateContent(c *goconfluence.Content) (*goconfluence.Content, error) {
+	var result *goconfluence.Content
+	err := l.call(func() (err error) {
+		result, err = l.api.UpdateContent(c)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) GetLabels(id string) (*goconfluence.Labels, error) {
+	var result *goconfluence.Labels
+	err := l.call(func() (err error) {
+		result, err = l.api.GetLabels(id)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) AddLabels(id string, labels *[]goconfluence.Label) (*goconfluence.Labels, error) {
+	var result *goconfluence.Labels
+	err := l.call(func() (err error) {
+		result, err = l.api.AddLabels(id, labels)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) DeleteLabel(id string, name string) (*goconfluence.Labels, error) {
+	var result *goconfluence.Labels
+	err := l.call(func() (err error) {
+		result, err = l.api.DeleteLabel(id, name)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) GetAttachments(id string) (*goconfluence.Search, error) {
+	var result *goconfluence.Search
+	err := l.call(func() (err error) {
+		result, err = l.api.GetAttachments(id)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) UploadAttachment(id, attachmentName string, attachment io.Reader) (*goconfluence.Search, error) {
+	var result *goconfluence.Search
+	err := l.call(func() (err error) {
+		result, err = l.api.UploadAttachment(id, attachmentName, attachment)
+		return err
+	})
+	return result, err
+}
+
+func (l *Limited) UpdateAttachment(id, attachmentName, attachmentID string, attachment io.Reader) (*goconfluence.Search, error) {
+	var result *goconfluence.Search
+	err := l.call(func() (err error) {
+		result, err = l.api.UpdateAttachment(id, attachmentName, attachmentID, attachment)
+		return err
+	})
+	return result, err
+}
+
+// call waits for rate limiter headroom, then runs fn, retrying with
+// exponential backoff if it fails with a retryable error.
+func (l *Limited) call(fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if waitErr := l.limiter.Wait(context.Background()); waitErr != nil {
+			return waitErr
+		}
+
+		err = fn()
+		if err == nil || !retryable(err) || attempt >= l.maxRetries {
+			return err
+		}
+
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// backoff returns an exponentially increasing delay: 500ms, 1s, 2s, 4s, ...
+func backoff(attempt int) time.Duration {
+	return (500 * time.Millisecond) << uint(attempt)
+}
+
+// retryable reports whether err looks like a throttling (429) or server-side
+// (5xx) failure worth retrying, based on the status text goconfluence embeds
+// in its error messages.
+func retryable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{
+		"429", "too many requests",
+		"500", "internal server error",
+		"502", "bad gateway",
+		"503", "service unavailable", "service is not available",
+		"504", "gateway timeout",
+	} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// uploadTask is a single file that's been fully rendered and is ready to be
+// uploaded, pending whatever else it depends on in the same run.
+type uploadTask struct {
+	df   DiscoveredFile
+	fm   FrontMatterStruct
+	html string
+}
+
+// planUploadOrder pre-renders every discovered file and groups them into
+// dependency layers: a file whose parent_title matches another file's
+// page_title in the same run lands in a later layer than its parent, so by
+// the time it's uploaded, GetPageFromName can already find that parent.
+// Everything else - the common case, since most parents already exist in
+// Confluence or are given by ID - ends up in the first layer and can run
+// fully concurrently.
+func planUploadOrder(uploader *Uploader, files []DiscoveredFile) ([][]*uploadTask, error) {
+	tasks := make([]*uploadTask, 0, len(files))
+	byTitle := make(map[string]*uploadTask, len(files))
+
+	for _, df := range files {
+		data, err := ioutil.ReadFile(df.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", df.Path, err)
+		}
+
+		fm, html, err := uploader.RenderFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", df.Path, err)
+		}
+		fm.applyDefaults(df.Defaults)
+
+		task := &uploadTask{df: df, fm: fm, html: html}
+		tasks = append(tasks, task)
+		if len(fm.PageTitle) != 0 {
+			byTitle[fm.PageTitle] = task
+		}
+	}
+
+	parentOf := make(map[*uploadTask]*uploadTask, len(tasks))
+	for _, task := range tasks {
+		if len(task.fm.ParentTitle) == 0 {
+			continue
+		}
+		if parent, ok := byTitle[task.fm.ParentTitle]; ok && parent != task {
+			parentOf[task] = parent
+		}
+	}
+
+	remaining := make(map[*uploadTask]bool, len(tasks))
+	for _, task := range tasks {
+		remaining[task] = true
+	}
+
+	var layers [][]*uploadTask
+	for len(remaining) > 0 {
+		var layer []*uploadTask
+		for task := range remaining {
+			if parent, ok := parentOf[task]; !ok || !remaining[parent] {
+				layer = append(layer, task)
+			}
+		}
+		if len(layer) == 0 {
+			// Every task left is part of, or waits on, a cycle - e.g. two
+			// files naming each other's page_title as their parent_title.
+			// Put them all in one final layer rather than loop forever.
+			for task := range remaining {
+				layer = append(layer, task)
+			}
+		}
+		for _, task := range layer {
+			delete(remaining, task)
+		}
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
+
+// uploadReport tallies what happened across a run, so UploadCmd can print a
+// summary and decide its exit code without re-deriving either from logs.
+type uploadReport struct {
+	Created int
+	Updated int
+	Skipped int
+	Failed  int
+}
+
+// Log prints a one-line summary of the report.
+func (r uploadReport) Log() {
+	log.Info().Msgf("Upload summary: %d created, %d updated, %d skipped, %d failed", r.Created, r.Updated, r.Skipped, r.Failed)
+}
+
+// runUploadLayers uploads every task in layers, running up to concurrency
+// tasks in parallel within a layer but waiting for a layer to fully finish
+// before starting the next, so a task never starts before the parent it
+// depends on has been created.
+func runUploadLayers(uploader *Uploader, layers [][]*uploadTask, concurrency int) uploadReport {
+	var report uploadReport
+	sem := make(chan struct{}, concurrency)
+
+	for _, layer := range layers {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+
+		for _, task := range layer {
+			wg.Add(1)
+			go func(task *uploadTask) {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				status, err := uploader.uploadRendered(task.df, task.fm, task.html)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				switch {
+				case err != nil:
+					report.Failed++
+					log.Error().Err(err).Msgf("Failed to upload %s", task.df.Path)
+				case status == UploadStatusCreated:
+					report.Created++
+					log.Info().Msgf("Created page successfully for %s", task.df.Path)
+				case status == UploadStatusUpdated:
+					report.Updated++
+					log.Info().Msgf("Updated page successfully for %s", task.df.Path)
+				default:
+					report.Skipped++
+				}
+			}(task)
+		}
+
+		wg.Wait()
+	}
+
+	return report
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/markdown2confluence/ratelimit"
+)
+
+// errExitCode is returned by a subcommand's Run to signal a non-zero exit
+// without duplicating a log message that's already been emitted per-file.
+var errExitCode = errors.New("one or more files failed to process")
+
+// UploadCmd renders every markdown file found under Paths and uploads it to
+// Confluence once, then exits. It's the default subcommand, preserving today's
+// behaviour of `markdown2confluence <path>`.
+type UploadCmd struct {
+	ConnectionFlags
+	PathFlags
+	MacroFlags
+
+	Concurrency int `default:"0" help:"Number of files to upload in parallel (default: min(NumCPU, 4))"`
+}
+
+func (c *UploadCmd) Run() error {
+	files, err := discoverFiles(c.Paths, c.Recursive)
+	if err != nil {
+		return err
+	}
+
+	api, err := goconfluence.NewAPI(c.BaseURL+"/wiki/rest/api", c.User, c.Password)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create API client")
+	}
+
+	renderer, shortcodes, err := newRenderer(c.MacroFlags)
+	if err != nil {
+		return err
+	}
+
+	syncCache, err := openSyncCache(c.BaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to open sync cache: %w", err)
+	}
+
+	limited := ratelimit.New(api, c.RateLimit, c.MaxRetries)
+	uploader := NewUploader(limited, renderer, shortcodes, syncCache, c.DefaultSpace, c.DefaultAncestor)
+
+	layers, err := planUploadOrder(uploader, files)
+	if err != nil {
+		return err
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+		if concurrency > 4 {
+			concurrency = 4
+		}
+	}
+
+	report := runUploadLayers(uploader, layers, concurrency)
+	report.Log()
+
+	if err := syncCache.Save(); err != nil {
+		log.Error().Err(err).Msg("Failed to save sync cache")
+	}
+
+	if report.Failed > 0 {
+		return errExitCode
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/ericaro/frontmatter"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/markdown2confluence/attachments"
+	"github.com/terrycain/markdown2confluence/cache"
+	"github.com/terrycain/markdown2confluence/macros"
+	"github.com/terrycain/markdown2confluence/ratelimit"
+)
+
+// UploadStatus describes the outcome of rendering and uploading a single file.
+type UploadStatus int
+
+const (
+	// UploadStatusSkipped means the page content hash hadn't changed, so nothing was sent to Confluence.
+	UploadStatusSkipped UploadStatus = iota
+	// UploadStatusCreated means a new Confluence page was created.
+	UploadStatusCreated
+	// UploadStatusUpdated means an existing Confluence page was updated.
+	UploadStatusUpdated
+)
+
+// Uploader renders a single markdown file and syncs it to Confluence. It holds
+// everything that's shared across files in a run, so both the one-shot upload
+// command and the watch command can drive it without duplicating the pipeline.
+type Uploader struct {
+	API             ratelimit.API
+	Renderer        *html.Renderer
+	Shortcodes      *macros.ShortcodeRegistry
+	Attachments     *attachments.Manager
+	Cache           *cache.Cache
+	Hierarchy       *HierarchyResolver
+	DefaultSpace    string
+	DefaultAncestor string
+}
+
+// NewUploader builds an Uploader around an already configured Confluence API client.
+func NewUploader(api ratelimit.API, renderer *html.Renderer, shortcodes *macros.ShortcodeRegistry, syncCache *cache.Cache, defaultSpace, defaultAncestor string) *Uploader {
+	return &Uploader{
+		API:             api,
+		Renderer:        renderer,
+		Shortcodes:      shortcodes,
+		Attachments:     attachments.NewManager(api),
+		Cache:           syncCache,
+		Hierarchy:       NewHierarchyResolver(api),
+		DefaultSpace:    defaultSpace,
+		DefaultAncestor: defaultAncestor,
+	}
+}
+
+// RenderFile parses the frontmatter of file and renders its markdown content to
+// Confluence storage format HTML, without touching the Confluence API. It's used
+// by both UploadFile and the watch command's preview server.
+func (u *Uploader) RenderFile(data []byte) (FrontMatterStruct, string, error) {
+	frontmatterPass := FrontMatterStruct{}
+	if err := frontmatter.Unmarshal(data, &frontmatterPass); err != nil {
+		return frontmatterPass, "", fmt.Errorf("failed to process frontmatter: %w", err)
+	}
+
+	h := sha256.New()
+	if _, err := h.Write([]byte(frontmatterPass.Content)); err != nil {
+		return frontmatterPass, "", fmt.Errorf("failed to hash content: %w", err)
+	}
+	frontmatterPass.ContentSHA = "sha-" + hex.EncodeToString(h.Sum(nil))[0:8]
+
+	// Shortcodes are swapped out for placeholder HTML comments before the
+	// markdown parser ever sees them, so they survive rendering untouched,
+	// then swapped back in for their rendered macro XML afterwards.
+	strippedContent, placeholders := macros.ExtractShortcodes(frontmatterPass.Content)
+	htmlData := markdown.ToHTML([]byte(strippedContent), nil, u.Renderer)
+
+	resolvedHTML, err := u.Shortcodes.Resolve(string(htmlData), placeholders)
+	if err != nil {
+		return frontmatterPass, "", fmt.Errorf("failed to resolve shortcodes: %w", err)
+	}
+
+	return frontmatterPass, resolvedHTML, nil
+}
+
+// UploadFile renders df's file and creates or updates the corresponding Confluence
+// page, skipping the upload entirely if the page's content hash label already matches.
+func (u *Uploader) UploadFile(df DiscoveredFile, data []byte) (UploadStatus, error) {
+	frontmatterPass, htmlData, err := u.RenderFile(data)
+	if err != nil {
+		return UploadStatusSkipped, err
+	}
+	frontmatterPass.applyDefaults(df.Defaults)
+
+	return u.uploadRendered(df, frontmatterPass, htmlData)
+}
+
+// uploadRendered does the actual create/update work for a file that's
+// already been rendered (and had its frontmatter defaults applied). It's
+// split out from UploadFile so a caller that needs to pre-render every file
+// up front, e.g. to plan a parent-before-child upload order, doesn't have to
+// render the same file twice.
+func (u *Uploader) uploadRendered(df DiscoveredFile, frontmatterPass FrontMatterStruct, htmlData string) (UploadStatus, error) {
+	file := df.Path
+
+	// Merge in defaults if we need them
+	if len(frontmatterPass.Space) == 0 {
+		if len(u.DefaultSpace) == 0 {
+			return UploadStatusSkipped, fmt.Errorf("missing space or default space for file %s", file)
+		}
+		frontmatterPass.Space = u.DefaultSpace
+	}
+
+	if len(frontmatterPass.ParentID) == 0 {
+		switch {
+		case len(frontmatterPass.ParentTitle) != 0:
+			// Get page id of parent if title is provided
+			page, _, err := GetPageFromName(u.API, frontmatterPass.Space, frontmatterPass.ParentTitle)
+			if err != nil {
+				return UploadStatusSkipped, fmt.Errorf("got error looking up page id for file %s: %w", file, err)
+			}
+			frontmatterPass.ParentID = page.ID
+		case df.Defaults.ParentTitleFromPath:
+			parentID, err := u.Hierarchy.Ensure(frontmatterPass.Space, df.RelDir, u.DefaultAncestor)
+			if err != nil {
+				return UploadStatusSkipped, fmt.Errorf("got error building parent hierarchy for file %s: %w", file, err)
+			}
+			frontmatterPass.ParentID = parentID
+		case len(u.DefaultAncestor) == 0:
+			return UploadStatusSkipped, fmt.Errorf("missing parent id/title or default ancestor for file %s", file)
+		default:
+			frontmatterPass.ParentID = u.DefaultAncestor
+		}
+	}
+
+	if len(frontmatterPass.PageTitle) == 0 {
+		return UploadStatusSkipped, fmt.Errorf("frontmatter missing page title for file %s", file)
+	}
+
+	images := attachments.DiscoverLocalImages([]byte(frontmatterPass.Content), filepath.Dir(file))
+	assetsChanged, err := u.assetsChanged(images)
+	if err != nil {
+		return UploadStatusSkipped, fmt.Errorf("got error checking attachments for file %s: %w", file, err)
+	}
+
+	// Look the page up by this file's own path first, so a page renamed or
+	// moved in its frontmatter is updated in place rather than mistaken for a
+	// new document - a title-based lookup would no longer find it under its
+	// old title. Only fall back to a title search for files the cache hasn't
+	// seen before.
+	cached, haveCached := u.Cache.Get(file)
+	// A cached entry from a different space (e.g. a watch --draft-space run
+	// sharing the same base URL) doesn't identify this file's page in the
+	// space we're uploading to now - trusting its PageID could move or
+	// overwrite a page that only exists in that other space.
+	cacheUsable := haveCached && cached.Space == frontmatterPass.Space
+	var page goconfluence.Content
+	var found bool
+	if cacheUsable && len(cached.PageID) != 0 {
+		if existing, err := u.API.GetContentByID(cached.PageID, goconfluence.ContentQuery{}); err == nil && existing != nil && len(existing.ID) != 0 {
+			page, found = *existing, true
+		}
+	}
+	if !found {
+		page, found, err = GetPageFromName(u.API, frontmatterPass.Space, frontmatterPass.PageTitle)
+		if err != nil {
+			return UploadStatusSkipped, fmt.Errorf("got error looking up page for file %s: %w", file, err)
+		}
+	}
+
+	if found {
+		// A page rename/move needs uploading even if the content itself
+		// didn't change, since the cache is what's tracking that identity.
+		renamedOrMoved := cacheUsable && (cached.LastTitle != frontmatterPass.PageTitle || cached.ParentID != frontmatterPass.ParentID)
+
+		// get page version
+		version, err := GetPageVersion(u.API, page.ID)
+		if err != nil {
+			return UploadStatusSkipped, fmt.Errorf("got error getting page hash: %w", err)
+		}
+
+		// update page
+		pageHashLabel, err := GetHashFromLabels(u.API, page.ID, df.Defaults.contentLabelPrefix())
+		if err != nil {
+			return UploadStatusSkipped, fmt.Errorf("got error looking up page labels for file %s: %w", file, err)
+		}
+
+		if !renamedOrMoved && !assetsChanged && pageHashLabel.Name == frontmatterPass.ContentSHA {
+			log.Info().Msgf("No update needed for %s", file)
+			return UploadStatusSkipped, nil
+		}
+
+		// Have update, so need to remove label, update, add new label
+		if len(pageHashLabel.Name) != 0 {
+			if _, err := u.API.DeleteLabel(page.ID, pageHashLabel.Name); err != nil {
+				return UploadStatusSkipped, fmt.Errorf("got error removing page label for file %s: %w", file, err)
+			}
+		}
+
+		attachmentSHAs, err := u.syncAttachments(page.ID, images, df.Defaults.LabelPrefix)
+		if err != nil {
+			return UploadStatusSkipped, fmt.Errorf("failed to sync attachments for file %s: %w", file, err)
+		}
+
+		pageContent := goconfluence.Content{
+			ID:    page.ID,
+			Title: frontmatterPass.PageTitle,
+			Version: goconfluence.Version{
+				Number: version + 1,
+			},
+			Type:   "page",
+			Space:  goconfluence.Space{Key: frontmatterPass.Space},
+			Status: "current",
+			Ancestors: []goconfluence.Ancestor{
+				{ID: frontmatterPass.ParentID},
+			},
+			Body: goconfluence.Body{
+				Storage: goconfluence.Storage{
+					Value:          htmlData,
+					Representation: "storage",
+				},
+			},
+		}
+
+		if _, err := u.API.UpdateContent(&pageContent); err != nil {
+			return UploadStatusSkipped, fmt.Errorf("failed to update page content for file %s: %w", file, err)
+		}
+
+		labels := []goconfluence.Label{
+			{Name: frontmatterPass.ContentSHA},
+		}
+		if _, err := u.API.AddLabels(page.ID, &labels); err != nil {
+			return UploadStatusSkipped, fmt.Errorf("failed to update page labels for file %s: %w", file, err)
+		}
+
+		u.updateCache(file, page.ID, frontmatterPass, images, attachmentSHAs)
+		return UploadStatusUpdated, nil
+	}
+
+	// Create the page first, with an empty body, purely to get a page ID that
+	// attachments can be scoped to - the real body, which already references
+	// attachments by filename, is written once they've been uploaded.
+	stub := goconfluence.Content{
+		Title:  frontmatterPass.PageTitle,
+		Type:   "page",
+		Space:  goconfluence.Space{Key: frontmatterPass.Space},
+		Status: "current",
+		Ancestors: []goconfluence.Ancestor{
+			{ID: frontmatterPass.ParentID},
+		},
+		Body: goconfluence.Body{
+			Storage: goconfluence.Storage{
+				Value:          "",
+				Representation: "storage",
+			},
+		},
+	}
+
+	newPage, err := u.API.CreateContent(&stub)
+	if err != nil {
+		return UploadStatusSkipped, fmt.Errorf("failed to create page for file %s: %w", file, err)
+	}
+
+	attachmentSHAs, err := u.syncAttachments(newPage.ID, images, df.Defaults.LabelPrefix)
+	if err != nil {
+		return UploadStatusSkipped, fmt.Errorf("failed to sync attachments for file %s: %w", file, err)
+	}
+
+	pageContent := goconfluence.Content{
+		ID:    newPage.ID,
+		Title: frontmatterPass.PageTitle,
+		Version: goconfluence.Version{
+			Number: 2,
+		},
+		Type:   "page",
+		Space:  goconfluence.Space{Key: frontmatterPass.Space},
+		Status: "current",
+		Ancestors: []goconfluence.Ancestor{
+			{ID: frontmatterPass.ParentID},
+		},
+		Body: goconfluence.Body{
+			Storage: goconfluence.Storage{
+				Value:          htmlData,
+				Representation: "storage",
+			},
+		},
+	}
+
+	if _, err := u.API.UpdateContent(&pageContent); err != nil {
+		return UploadStatusSkipped, fmt.Errorf("failed to set initial content for file %s: %w", file, err)
+	}
+
+	labels := []goconfluence.Label{
+		{Name: frontmatterPass.ContentSHA},
+	}
+	if _, err := u.API.AddLabels(newPage.ID, &labels); err != nil {
+		return UploadStatusSkipped, fmt.Errorf("failed to update page labels for file %s: %w", file, err)
+	}
+
+	// If this file had a cached page ID that's no longer around (the page was
+	// deleted and is now being recreated under a new ID), any cached children
+	// pointing at the old ID as their ParentID are now stale - drop them so
+	// their next upload re-resolves its parent rather than trusting it.
+	if cacheUsable && len(cached.PageID) != 0 && cached.PageID != newPage.ID {
+		for _, child := range u.Cache.Children(cached.PageID) {
+			u.Cache.Invalidate(child)
+		}
+	}
+
+	u.updateCache(file, newPage.ID, frontmatterPass, images, attachmentSHAs)
+	return UploadStatusCreated, nil
+}
+
+// syncAttachments uploads every local image in images to pageID, returning
+// each one's content hash keyed by filename for the cache to remember.
+// labelPrefix namespaces the attachment hash labels, same as the page's own
+// content-hash label - see FrontMatterDefaults.LabelPrefix.
+func (u *Uploader) syncAttachments(pageID string, images []attachments.LocalImage, labelPrefix string) (map[string]string, error) {
+	shas := make(map[string]string, len(images))
+	for _, image := range images {
+		if _, err := u.Attachments.Sync(pageID, image, labelPrefix); err != nil {
+			return nil, fmt.Errorf("failed to sync attachment %s: %w", image.Filename, err)
+		}
+		sha, err := fileSHA256(image.LocalPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash attachment %s: %w", image.Filename, err)
+		}
+		shas[image.Filename] = sha
+	}
+	return shas, nil
+}
+
+// assetsChanged reports whether any of images has a content hash that
+// differs from what the cache recorded as of the last upload that
+// referenced it - i.e. a shared asset changed, so pages referencing it need
+// re-uploading even though their own markdown content hasn't.
+func (u *Uploader) assetsChanged(images []attachments.LocalImage) (bool, error) {
+	for _, image := range images {
+		sha, err := fileSHA256(image.LocalPath)
+		if err != nil {
+			return false, err
+		}
+		if cached, ok := u.Cache.AssetSHA(image.LocalPath); !ok || cached != sha {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateCache records file's successful upload, including the current
+// content hash of every local asset it references, so a later run can detect
+// a shared asset changing out from under an otherwise-unchanged page.
+func (u *Uploader) updateCache(file, pageID string, fm FrontMatterStruct, images []attachments.LocalImage, attachmentSHAs map[string]string) {
+	dependencies := make([]string, 0, len(images))
+	for _, image := range images {
+		dependencies = append(dependencies, image.LocalPath)
+		if sha, ok := attachmentSHAs[image.Filename]; ok {
+			u.Cache.SetAssetSHA(image.LocalPath, sha)
+		}
+	}
+
+	u.Cache.Set(file, cache.Entry{
+		PageID:         pageID,
+		Space:          fm.Space,
+		LastTitle:      fm.PageTitle,
+		ContentSHA:     fm.ContentSHA,
+		AttachmentSHAs: attachmentSHAs,
+		ParentID:       fm.ParentID,
+		Dependencies:   dependencies,
+		LastUploadedAt: time.Now(),
+	})
+}
+
+// fileSHA256 returns a path's content hash, hex-encoded.
+func fileSHA256(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
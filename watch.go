@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cseeger-epages/confluence-go-api"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/markdown2confluence/ratelimit"
+)
+
+// WatchCmd watches Paths for markdown changes, rendering and uploading each
+// changed file through the same Uploader the one-shot upload command uses. It
+// also serves the rendered storage-format HTML locally so authors can check
+// their changes without round-tripping through the real Confluence instance.
+type WatchCmd struct {
+	ConnectionFlags
+	PathFlags
+	MacroFlags
+
+	DraftSpace  string        `env:"CONFLUENCE_DRAFT_SPACE" help:"Space to upload into for files that set no space of their own, in place of the default space; files whose frontmatter or defaults file sets a space are still uploaded there"`
+	PreviewAddr string        `default:"127.0.0.1:8090" help:"Address the local preview HTTP server listens on"`
+	Debounce    time.Duration `default:"300ms" help:"How long to wait after the last filesystem event before re-rendering a file"`
+}
+
+// previewServer serves the most recently rendered storage-format HTML for each
+// watched file at /preview/<path>.
+type previewServer struct {
+	mu   sync.RWMutex
+	html map[string]string
+}
+
+func newPreviewServer() *previewServer {
+	return &previewServer{html: make(map[string]string)}
+}
+
+func (p *previewServer) set(file, body string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.html[file] = body
+}
+
+func (p *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(r.URL.Path, "/preview/")
+
+	p.mu.RLock()
+	body, ok := p.html[file]
+	p.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprint(w, body)
+}
+
+func (c *WatchCmd) Run() error {
+	api, err := goconfluence.NewAPI(c.BaseURL+"/wiki/rest/api", c.User, c.Password)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create API client")
+	}
+
+	renderer, shortcodes, err := newRenderer(c.MacroFlags)
+	if err != nil {
+		return err
+	}
+
+	space := c.DefaultSpace
+	if len(c.DraftSpace) != 0 {
+		space = c.DraftSpace
+	}
+
+	syncCache, err := openSyncCache(c.BaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to open sync cache: %w", err)
+	}
+	defer func() {
+		if err := syncCache.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save sync cache")
+		}
+	}()
+
+	limited := ratelimit.New(api, c.RateLimit, c.MaxRetries)
+	uploader := NewUploader(limited, renderer, shortcodes, syncCache, space, c.DefaultAncestor)
+
+	preview := newPreviewServer()
+	go func() {
+		log.Info().Msgf("Serving previews on http://%s/preview/<path>", c.PreviewAddr)
+		if err := http.ListenAndServe(c.PreviewAddr, preview); err != nil {
+			log.Error().Err(err).Msg("Preview server stopped")
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	for _, item := range c.Paths {
+		if err := addWatch(watcher, item, c.Recursive); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", item, err)
+		}
+	}
+
+	// Render+upload everything once up front so the preview server has content
+	// before the first filesystem event arrives.
+	files, err := discoverFiles(c.Paths, c.Recursive)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		c.processFile(uploader, preview, file)
+	}
+
+	pending := make(map[string]bool)
+	var debounceTimer *time.Timer
+	var mu sync.Mutex
+
+	flush := func() {
+		mu.Lock()
+		toProcess := make([]string, 0, len(pending))
+		for file := range pending {
+			toProcess = append(toProcess, file)
+		}
+		pending = make(map[string]bool)
+		mu.Unlock()
+
+		if len(toProcess) == 0 {
+			return
+		}
+
+		// Re-discover files so a changed one picks up any cascading
+		// directory defaults rather than just its own directory's.
+		current, err := discoverFiles(c.Paths, c.Recursive)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to re-discover files")
+			return
+		}
+		byPath := make(map[string]DiscoveredFile, len(current))
+		for _, df := range current {
+			byPath[df.Path] = df
+		}
+
+		for _, file := range toProcess {
+			df, ok := byPath[file]
+			if !ok {
+				// Deleted, or no longer matches - nothing to process.
+				continue
+			}
+			c.processFile(uploader, preview, df)
+		}
+
+		if err := syncCache.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save sync cache")
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			absPath, err := filepath.Abs(event.Name)
+			if err != nil {
+				continue
+			}
+
+			var affected []string
+			if isMarkdownFile(absPath) {
+				affected = []string{absPath}
+			} else {
+				// A shared asset (e.g. an image) changed - re-upload every
+				// markdown file that references it rather than the asset
+				// itself, since the asset isn't a file findFiles ever sees.
+				affected = syncCache.Dependents(absPath)
+			}
+			if len(affected) == 0 {
+				continue
+			}
+
+			mu.Lock()
+			for _, file := range affected {
+				pending[file] = true
+			}
+			mu.Unlock()
+
+			if debounceTimer != nil {
+				debounceTimer.Stop()
+			}
+			debounceTimer = time.AfterFunc(c.Debounce, flush)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error().Err(err).Msg("Watcher error")
+		}
+	}
+}
+
+func (c *WatchCmd) processFile(uploader *Uploader, preview *previewServer, file DiscoveredFile) {
+	log.Debug().Msgf("Processing %s", file.Path)
+
+	data, err := ioutil.ReadFile(file.Path)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read contents of %s, skipping", file.Path)
+		return
+	}
+
+	_, renderedHTML, err := uploader.RenderFile(data)
+	if err == nil {
+		preview.set(file.Path, renderedHTML)
+	}
+
+	status, err := uploader.UploadFile(file, data)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to upload %s", file.Path)
+		return
+	}
+
+	switch status {
+	case UploadStatusCreated:
+		log.Info().Msgf("Created page successfully for %s", file.Path)
+	case UploadStatusUpdated:
+		log.Info().Msgf("Updated page successfully for %s", file.Path)
+	}
+}
+
+func discoverFiles(paths []string, recursive bool) ([]DiscoveredFile, error) {
+	files := make([]DiscoveredFile, 0)
+	for _, item := range paths {
+		newFiles, err := findFiles(item, recursive)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, newFiles...)
+	}
+	return files, nil
+}
+
+func isMarkdownFile(name string) bool {
+	info, err := os.Stat(name)
+	if err != nil {
+		return filepath.Ext(name) == ".md"
+	}
+	return !info.IsDir() && filepath.Ext(name) == ".md"
+}
+
+func addWatch(watcher *fsnotify.Watcher, root string, recursive bool) error {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return watcher.Add(filepath.Dir(root))
+	}
+
+	if !recursive {
+		return watcher.Add(root)
+	}
+
+	return filepath.Walk(root, func(walkedpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(walkedpath)
+		}
+		return nil
+	})
+}